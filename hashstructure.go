@@ -1,14 +1,26 @@
 package hashstructure
 
 import (
+	"encoding"
 	"encoding/binary"
 	"fmt"
 	"hash"
 	"hash/crc64"
 	"io"
 	"reflect"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
 )
 
+// Hashable can be implemented to override the hash value used for a
+// type. If a value implements Hashable, Hash() is called to obtain the
+// bytes to write into the hash instead of reflecting into the value.
+type Hashable interface {
+	Hash() ([]byte, error)
+}
+
 // HashOptions are options that are available for hashing.
 type HashOptions struct {
 	// Hasher is the hash function to use. If this isn't set, it will
@@ -20,8 +32,34 @@ type HashOptions struct {
 	// TagName is the struct tag to look at when hashing the structure.
 	// By default this is "hash".
 	TagName string
+
+	// Format selects the hashing scheme to use. If this isn't set, it
+	// will default to FormatV1, preserving the existing behavior of this
+	// package. Pass FormatV2 to opt into collision fixes that are not
+	// compatible with hashes produced under FormatV1.
+	Format Format
 }
 
+// Format specifies the hashing process used by Hash.
+type Format int
+
+const (
+	// FormatV1 is the original hashing format of this package. Map
+	// entries and set elements are combined by XOR-ing their hashes,
+	// which means entries can cancel each other out (e.g. a set
+	// containing a value twice hashes the same as an empty set), and
+	// scalars carry no kind tag, so e.g. nil and false (both written as
+	// a single zero byte) hash identically.
+	FormatV1 Format = iota
+
+	// FormatV2 fixes the FormatV1 collisions above: map/set entries are
+	// combined with a multiply-and-add scheme over the entry count
+	// instead of XOR, a one-byte kind tag is written before scalar
+	// values, and strings are length-prefixed. FormatV2 hashes are not
+	// comparable to FormatV1 hashes for the same input.
+	FormatV2
+)
+
 // Hash returns the hash value of an arbitrary value.
 //
 // If opts is nil, then default options will be used. See HashOptions
@@ -35,6 +73,13 @@ type HashOptions struct {
 //   * Adding an exported field to a struct with the zero value will change
 //     the hash value.
 //
+//   * Values implementing Hashable, encoding.BinaryMarshaler, or
+//     encoding.TextMarshaler are hashed using the bytes they produce
+//     instead of being reflected into. time.Time is special-cased to
+//     hash its instant and zone offset, so equal instants with the same
+//     offset hash equally regardless of which *time.Location they carry;
+//     the same instant at different offsets hashes differently.
+//
 // For structs, the hashing can be controlled using tags. For example:
 //
 //    struct {
@@ -49,8 +94,41 @@ type HashOptions struct {
 //   * "set" - The field will be treated as a set, where ordering doesn't
 //             affect the hash code. This only works for slices.
 //
+//   * "string" - The field will be hashed as its decimal string form
+//                instead of its binary encoding. Only works for numeric
+//                fields.
+//
+//   * "ignore-zero" - The field will be ignored if it is set to its
+//                      zero value. This lets new optional fields be
+//                      added without changing the hash of existing
+//                      values that don't set them.
+//
+//   * "name=X" - The field will be identified to Includable/IncludableMap
+//                as X instead of its Go field name. Field names are
+//                never themselves part of the hash, so this only
+//                affects what Includable/IncludableMap see; it has no
+//                effect on hash values for callers that don't implement
+//                those interfaces.
+//
+// Multiple options can be combined with commas, e.g.
+// `hash:"name=foo,ignore-zero"`.
+//
+// By default, opts.Format is FormatV1. Set it to FormatV2 to use a
+// hashing scheme that doesn't share FormatV1's map/set and scalar
+// collisions; note this produces different hash values for the same
+// input, so don't mix formats when comparing hashes.
 func Hash(v interface{}, opts *HashOptions) (uint64, error) {
-	// Create default options
+	w, h := newWalker(opts)
+	if err := w.visit(reflect.ValueOf(v), nil); err != nil {
+		return 0, err
+	}
+
+	return h.Sum64(), nil
+}
+
+// newWalker applies HashOptions defaults and returns a fresh walker
+// along with the underlying hash.Hash64 it writes to.
+func newWalker(opts *HashOptions) (*walker, hash.Hash64) {
 	if opts == nil {
 		opts = &HashOptions{}
 	}
@@ -61,24 +139,85 @@ func Hash(v interface{}, opts *HashOptions) (uint64, error) {
 		opts.TagName = "hash"
 	}
 
-	// Reset the hash
 	opts.Hasher.Reset()
 
-	// Create our walker and walk the structure
-	w := &walker{
-		w:   opts.Hasher,
-		tag: opts.TagName,
-	}
-	if err := w.visit(reflect.ValueOf(v), nil); err != nil {
-		return 0, err
-	}
+	return &walker{
+		w:      opts.Hasher,
+		tag:    opts.TagName,
+		format: opts.Format,
+	}, opts.Hasher
+}
+
+// Hasher incrementally folds a sequence of values into a single running
+// hash, without allocating a wrapper slice/struct to hold them first.
+// Unlike calling Hash repeatedly and combining the results, the
+// underlying hash.Hash64 is reused across Write calls instead of being
+// reset, so the result depends on the order of the values. Under
+// FormatV1 strings are written without a length prefix, so value
+// boundaries are not preserved (Write("ab") then Write("c") sums the
+// same as Write("a") then Write("bc")); FormatV2 length-prefixes them.
+type Hasher struct {
+	w    *walker
+	hash hash.Hash64
+}
+
+// NewHasher creates a Hasher. If opts is nil, default options are used;
+// see HashOptions for the default values.
+func NewHasher(opts *HashOptions) *Hasher {
+	w, h := newWalker(opts)
+	return &Hasher{w: w, hash: h}
+}
 
-	return opts.Hasher.Sum64(), nil
+// Write folds v into the running hash.
+func (h *Hasher) Write(v interface{}) error {
+	return h.w.visit(reflect.ValueOf(v), nil)
+}
+
+// Sum64 returns the hash of everything written so far.
+func (h *Hasher) Sum64() uint64 {
+	return h.hash.Sum64()
+}
+
+// Reset clears the Hasher back to the state it was in when created by
+// NewHasher.
+func (h *Hasher) Reset() {
+	h.hash.Reset()
+	h.w.visited = nil
+	h.w.visitedSlices = nil
 }
 
 type walker struct {
-	w   io.Writer
-	tag string
+	w      io.Writer
+	tag    string
+	format Format
+
+	// visited tracks addressable pointers/maps currently being walked on
+	// the current call stack, so that cyclic data structures (linked
+	// lists, graphs, etc.) can be hashed instead of overflowing the
+	// stack. Entries are added before recursing into the pointee and
+	// removed once that subtree has been fully visited.
+	visited map[visitedPtr]int
+
+	// visitedSlices does the same for non-empty slices. It's keyed
+	// separately from visited, and on (addr, type, len) rather than just
+	// (addr, type), because two slices can share a backing array (and
+	// thus address) while covering different elements, and those must
+	// not be mistaken for a cycle.
+	visitedSlices map[visitedSlice]int
+}
+
+type visitedSlice struct {
+	addr uintptr
+	typ  reflect.Type
+	len  int
+}
+
+// visitedPtr identifies a pointer or map by both its address and its
+// type. The type is included because two differently-typed values can
+// legitimately share an address (e.g. a struct and its first field).
+type visitedPtr struct {
+	addr uintptr
+	typ  reflect.Type
 }
 
 type visitOpts struct {
@@ -90,6 +229,96 @@ type visitOpts struct {
 	StructField string
 }
 
+// enterRef records that the pointer/map at addr (of type typ) is now
+// being walked. If it is already being walked (i.e. we've looped back to
+// it through a cycle), it returns the index assigned on the earlier
+// visit and cyclic=true; the caller should hash a back-reference marker
+// instead of recursing.
+func (w *walker) enterRef(addr uintptr, typ reflect.Type) (idx int, cyclic bool) {
+	key := visitedPtr{addr: addr, typ: typ}
+	if idx, ok := w.visited[key]; ok {
+		return idx, true
+	}
+
+	if w.visited == nil {
+		w.visited = make(map[visitedPtr]int)
+	}
+	idx = len(w.visited) + 1
+	w.visited[key] = idx
+	return idx, false
+}
+
+// leaveRef un-marks addr/typ as being walked. It must be called once the
+// subtree rooted at that pointer/map has been fully visited, typically
+// via defer right after a successful enterRef.
+func (w *walker) leaveRef(addr uintptr, typ reflect.Type) {
+	delete(w.visited, visitedPtr{addr: addr, typ: typ})
+}
+
+// enterSliceSpan is enterRef's counterpart for non-empty slices; see
+// visitedSlice for why slices are tracked separately from enterRef.
+func (w *walker) enterSliceSpan(addr uintptr, typ reflect.Type, length int) (idx int, cyclic bool) {
+	key := visitedSlice{addr: addr, typ: typ, len: length}
+	if idx, ok := w.visitedSlices[key]; ok {
+		return idx, true
+	}
+
+	if w.visitedSlices == nil {
+		w.visitedSlices = make(map[visitedSlice]int)
+	}
+	idx = len(w.visitedSlices) + 1
+	w.visitedSlices[key] = idx
+	return idx, false
+}
+
+// leaveSliceSpan un-marks addr/typ/len as being walked, mirroring
+// leaveRef for enterSliceSpan.
+func (w *walker) leaveSliceSpan(addr uintptr, typ reflect.Type, length int) {
+	delete(w.visitedSlices, visitedSlice{addr: addr, typ: typ, len: length})
+}
+
+// writeCycleMarker writes a value into the hash that stands in for a
+// back-reference to an ancestor in the current walk, so that cyclic
+// structures hash deterministically instead of recursing forever.
+func (w *walker) writeCycleMarker(idx int) error {
+	_, err := fmt.Fprintf(w.w, "<hashstructure:cycle:%d>", idx)
+	return err
+}
+
+// writeMarshaled calls fn to obtain a value's self-hashed bytes and
+// writes them, for the Hashable/BinaryMarshaler/TextMarshaler hooks in
+// visit.
+func (w *walker) writeMarshaled(fn func() ([]byte, error)) error {
+	bytes, err := fn()
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(bytes)
+	return err
+}
+
+// subHash computes a standalone hash of v into a fresh hash.Hash64, for
+// the map/set cases below that need each entry's hash as a uint64 to
+// combine rather than writing it inline. It shares w's visited and
+// visitedSlices with the sub-walker it builds (rather than calling the
+// package-level Hash, which would start both maps over empty) so that a
+// cycle which closes through a map value or a "set" slice element is
+// still caught instead of recursing forever.
+func (w *walker) subHash(v reflect.Value) (uint64, error) {
+	h := crc64.New(crc64.MakeTable(crc64.ECMA))
+	sub := &walker{
+		w:             h,
+		tag:           w.tag,
+		format:        w.format,
+		visited:       w.visited,
+		visitedSlices: w.visitedSlices,
+	}
+	if err := sub.visit(v, nil); err != nil {
+		return 0, err
+	}
+	return h.Sum64(), nil
+}
+
 func (w *walker) visit(v reflect.Value, opts *visitOpts) error {
 	// Loop since these can be wrapped in multiple layers of pointers
 	// and interfaces.
@@ -103,6 +332,17 @@ func (w *walker) visit(v reflect.Value, opts *visitOpts) error {
 		}
 
 		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v = reflect.Indirect(v)
+				break
+			}
+
+			idx, cyclic := w.enterRef(v.Pointer(), v.Type())
+			if cyclic {
+				return w.writeCycleMarker(idx)
+			}
+			defer w.leaveRef(v.Pointer(), v.Type())
+
 			v = reflect.Indirect(v)
 			continue
 		}
@@ -110,12 +350,63 @@ func (w *walker) visit(v reflect.Value, opts *visitOpts) error {
 		break
 	}
 
+	// Give the value a chance to hash itself before falling through to
+	// reflection. time.Time is checked explicitly ahead of
+	// BinaryMarshaler/TextMarshaler (both of which it also implements)
+	// so that its zone offset is normalized consistently regardless of
+	// *time.Location pointer identity.
+	//
+	// These interfaces are often implemented on the pointer receiver
+	// (e.g. *big.Int's MarshalText), so once visit has dereferenced down
+	// to an addressable value we also try v.Addr() and not just v.
+	if v.IsValid() {
+		var valIface, ptrIface interface{}
+		if v.CanInterface() {
+			valIface = v.Interface()
+		}
+		if v.CanAddr() && v.Addr().CanInterface() {
+			ptrIface = v.Addr().Interface()
+		}
+
+		if h, ok := valIface.(Hashable); ok {
+			return w.writeMarshaled(h.Hash)
+		}
+		if h, ok := ptrIface.(Hashable); ok {
+			return w.writeMarshaled(h.Hash)
+		}
+
+		if t, ok := valIface.(time.Time); ok {
+			_, zoneOffset := t.Zone()
+			if err := binary.Write(w.w, binary.LittleEndian, t.UnixNano()); err != nil {
+				return err
+			}
+			return binary.Write(w.w, binary.LittleEndian, int64(zoneOffset))
+		}
+
+		if m, ok := valIface.(encoding.BinaryMarshaler); ok {
+			return w.writeMarshaled(m.MarshalBinary)
+		}
+		if m, ok := ptrIface.(encoding.BinaryMarshaler); ok {
+			return w.writeMarshaled(m.MarshalBinary)
+		}
+
+		if m, ok := valIface.(encoding.TextMarshaler); ok {
+			return w.writeMarshaled(m.MarshalText)
+		}
+		if m, ok := ptrIface.(encoding.TextMarshaler); ok {
+			return w.writeMarshaled(m.MarshalText)
+		}
+	}
+
 	// If it is nil, treat it like a zero.
-	if !v.IsValid() {
+	isNil := !v.IsValid()
+	if isNil {
 		var tmp int8
 		v = reflect.ValueOf(tmp)
 	}
 
+	origKind := v.Kind()
+
 	// Binary writing can use raw ints, we have to convert to
 	// a sized-int, we'll choose the largest...
 	switch v.Kind() {
@@ -135,6 +426,22 @@ func (w *walker) visit(v reflect.Value, opts *visitOpts) error {
 
 	// We can shortcut numeric values by directly binary writing them
 	if k >= reflect.Int && k <= reflect.Complex64 {
+		if opts != nil && opts.Flags&visitFlagString != 0 {
+			_, err := fmt.Fprintf(w.w, "%v", v.Interface())
+			return err
+		}
+		if w.format == FormatV2 {
+			tag := hashV2KindNumeric
+			switch {
+			case isNil:
+				tag = hashV2KindNil
+			case origKind == reflect.Bool:
+				tag = hashV2KindBool
+			}
+			if err := binary.Write(w.w, binary.LittleEndian, tag); err != nil {
+				return err
+			}
+		}
 		return binary.Write(w.w, binary.LittleEndian, v.Interface())
 	}
 
@@ -148,6 +455,14 @@ func (w *walker) visit(v reflect.Value, opts *visitOpts) error {
 		}
 
 	case reflect.Map:
+		if !v.IsNil() {
+			idx, cyclic := w.enterRef(v.Pointer(), v.Type())
+			if cyclic {
+				return w.writeCycleMarker(idx)
+			}
+			defer w.leaveRef(v.Pointer(), v.Type())
+		}
+
 		var includeMap IncludableMap
 		if opts != nil && opts.Struct != nil {
 			if v, ok := opts.Struct.(IncludableMap); ok {
@@ -155,9 +470,14 @@ func (w *walker) visit(v reflect.Value, opts *visitOpts) error {
 			}
 		}
 
-		// Build the hash for the map. We do this by XOR-ing all the key
-		// and value hashes. This makes it deterministic despite ordering.
+		// Build the hash for the map. Under FormatV1 we do this by XOR-ing
+		// all the key and value hashes, which is deterministic despite
+		// ordering but lets entries collide with each other (and with an
+		// empty map) when they cancel out. Under FormatV2 we instead sum
+		// h(k)*P+h(v) in a 64-bit field and also fold in the entry count,
+		// which keeps the result order-independent without that collision.
 		var h uint64
+		var count uint64
 		for _, k := range v.MapKeys() {
 			v := v.MapIndex(k)
 			if includeMap != nil {
@@ -171,21 +491,41 @@ func (w *walker) visit(v reflect.Value, opts *visitOpts) error {
 				}
 			}
 
-			kh, err := Hash(k.Interface(), nil)
+			kh, err := w.subHash(k)
 			if err != nil {
 				return err
 			}
-			vh, err := Hash(v.Interface(), nil)
+			vh, err := w.subHash(v)
 			if err != nil {
 				return err
 			}
 
-			h = h ^ kh ^ vh
+			if w.format == FormatV2 {
+				h += kh*hashV2Prime + vh
+			} else {
+				h = h ^ kh ^ vh
+			}
+			count++
+		}
+
+		if w.format == FormatV2 {
+			if err := binary.Write(w.w, binary.LittleEndian, count); err != nil {
+				return err
+			}
 		}
 
 		return binary.Write(w.w, binary.LittleEndian, h)
 
 	case reflect.Struct:
+		// FormatV2 isn't implemented by the compiled fast path below, and
+		// the fast path reads fields by offset so the struct must be
+		// addressable.
+		if w.format == FormatV1 && v.CanAddr() {
+			if plan := structPlanFor(v.Type(), w.tag); plan != nil {
+				return plan.hash(v, w)
+			}
+		}
+
 		var include Includable
 		parent := v.Interface()
 		if impl, ok := parent.(Includable); ok {
@@ -195,58 +535,98 @@ func (w *walker) visit(v reflect.Value, opts *visitOpts) error {
 		t := v.Type()
 		l := v.NumField()
 		for i := 0; i < l; i++ {
-			if v := v.Field(i); v.CanSet() || t.Field(i).Name != "_" {
-				var f visitFlag
-				fieldType := t.Field(i)
-				tag := fieldType.Tag.Get(w.tag)
-				if tag == "ignore" {
-					// Ignore this field
-					continue
-				}
-
-				// Check if we implement includable and check it
-				if include != nil {
-					incl, err := include.HashInclude(fieldType.Name, v)
-					if err != nil {
-						return err
-					}
-					if !incl {
-						continue
-					}
-				}
+			fieldType := t.Field(i)
+			if fieldType.PkgPath != "" {
+				// Unexported field: ignored, per the doc on Hash. Doing
+				// this unconditionally (rather than the previous
+				// v.CanSet() check, which is always false for unexported
+				// fields regardless of addressability) keeps this in
+				// sync with the compiled fast path above, and avoids
+				// panicking on v.Interface() below for values that
+				// happen to be addressable.
+				continue
+			}
 
-				switch tag {
-				case "set":
-					f |= visitFlagSet
-				}
+			fv := v.Field(i)
+			tagOpts := parseFieldTag(fieldType.Tag.Get(w.tag))
+			if tagOpts.ignore {
+				// Ignore this field
+				continue
+			}
 
-				err := w.visit(v, &visitOpts{
-					Flags:       f,
-					Struct:      parent,
-					StructField: fieldType.Name,
-				})
+			// Check if we implement includable and check it
+			if include != nil {
+				incl, err := include.HashInclude(fieldType.Name, fv)
 				if err != nil {
 					return err
 				}
+				if !incl {
+					continue
+				}
+			}
+
+			if tagOpts.ignoreZero && fv.IsZero() {
+				continue
+			}
+
+			var f visitFlag
+			if tagOpts.set {
+				f |= visitFlagSet
+			}
+			if tagOpts.string {
+				f |= visitFlagString
+			}
+
+			structField := fieldType.Name
+			if tagOpts.name != "" {
+				structField = tagOpts.name
+			}
+
+			err := w.visit(fv, &visitOpts{
+				Flags:       f,
+				Struct:      parent,
+				StructField: structField,
+			})
+			if err != nil {
+				return err
 			}
 		}
 
 	case reflect.Slice:
+		l := v.Len()
+
+		// Guard against slices that (directly or transitively) contain
+		// themselves, e.g. s := make([]interface{}, 1); s[0] = s. An
+		// empty slice can't reference anything, so there's nothing to
+		// track for it.
+		if l > 0 {
+			idx, cyclic := w.enterSliceSpan(v.Pointer(), v.Type(), l)
+			if cyclic {
+				return w.writeCycleMarker(idx)
+			}
+			defer w.leaveSliceSpan(v.Pointer(), v.Type(), l)
+		}
+
 		// We have two behaviors here. If it isn't a set, then we just
 		// visit all the elements. If it is a set, then we do a deterministic
 		// hash code.
 		var h uint64
+		var count uint64
 		var set bool
 		if opts != nil {
 			set = (opts.Flags & visitFlagSet) != 0
 		}
-		l := v.Len()
 		for i := 0; i < l; i++ {
 			var err error
 			if set {
 				var hc uint64
-				hc, err = Hash(v.Index(i).Interface(), nil)
-				h = h ^ hc
+				hc, err = w.subHash(v.Index(i))
+				if w.format == FormatV2 {
+					h += hc * hashV2Prime
+				} else {
+					h = h ^ hc
+				}
+				count++
 			} else {
 				err = w.visit(v.Index(i), nil)
 			}
@@ -256,10 +636,23 @@ func (w *walker) visit(v reflect.Value, opts *visitOpts) error {
 		}
 
 		if set {
+			if w.format == FormatV2 {
+				if err := binary.Write(w.w, binary.LittleEndian, count); err != nil {
+					return err
+				}
+			}
 			return binary.Write(w.w, binary.LittleEndian, h)
 		}
 
 	case reflect.String:
+		if w.format == FormatV2 {
+			if err := binary.Write(w.w, binary.LittleEndian, hashV2KindString); err != nil {
+				return err
+			}
+			if err := binary.Write(w.w, binary.LittleEndian, uint64(v.Len())); err != nil {
+				return err
+			}
+		}
 		_, err := w.w.Write([]byte(v.String()))
 		return err
 
@@ -275,4 +668,260 @@ type visitFlag uint
 const (
 	visitFlagInvalid visitFlag = iota
 	visitFlagSet               = iota << 1
+	visitFlagString            = iota << 1
+)
+
+// fieldTagOptions is the parsed form of a struct field's hash tag, e.g.
+// `hash:"name=foo,ignore-zero"`.
+type fieldTagOptions struct {
+	// ignore skips the field entirely, from "ignore".
+	ignore bool
+
+	// set treats a slice field as an unordered set, from "set".
+	set bool
+
+	// ignoreZero skips the field when it holds its zero value, from
+	// "ignore-zero". This lets new optional fields be added without
+	// changing the hash of values that don't set them.
+	ignoreZero bool
+
+	// string hashes numeric fields via their decimal string form
+	// instead of their binary encoding, from "string". Useful for
+	// cross-language hash stability.
+	string bool
+
+	// name overrides the field name used to identify this field to
+	// Includable/IncludableMap, from "name=X". Field names aren't part
+	// of the hash itself, so this only affects what Includable/
+	// IncludableMap see, not the hash value.
+	name string
+}
+
+func parseFieldTag(tag string) fieldTagOptions {
+	var opts fieldTagOptions
+	if tag == "" {
+		return opts
+	}
+
+	for _, part := range strings.Split(tag, ",") {
+		switch {
+		case part == "ignore":
+			opts.ignore = true
+		case part == "set":
+			opts.set = true
+		case part == "ignore-zero":
+			opts.ignoreZero = true
+		case part == "string":
+			opts.string = true
+		case strings.HasPrefix(part, "name="):
+			opts.name = strings.TrimPrefix(part, "name=")
+		}
+	}
+
+	return opts
+}
+
+// hashV2Prime is a large odd 64-bit multiplier used to combine map and
+// set entries under FormatV2. It's the 64-bit golden ratio constant
+// (2^64 divided by the golden ratio, made odd; it is not itself prime)
+// commonly used for mixing hashes; any large odd constant works, the
+// key property is that it doesn't preserve the additive collisions that
+// XOR does.
+const hashV2Prime = 0x9E3779B97F4A7C15
+
+// hashV2Kind tags are written before scalar values under FormatV2 so
+// that values which would otherwise share an encoding (e.g. int64(0),
+// "", nil, and false) no longer collide.
+type hashV2Kind uint8
+
+const (
+	hashV2KindNil hashV2Kind = iota
+	hashV2KindBool
+	hashV2KindNumeric
+	hashV2KindString
+)
+
+// structPlanCache holds a compiled *structPlan (or a nil one, for types
+// ineligible for the fast path) per struct type and tag name, so that
+// the tag parsing and Includable checks below are only done once per
+// type rather than on every Hash call. This is the dominant cost for
+// workloads that repeatedly hash the same struct type.
+var structPlanCache sync.Map // map[structPlanKey]*structPlan
+
+type structPlanKey struct {
+	typ reflect.Type
+	tag string
+}
+
+// structFieldKind identifies which fixed-width field types the
+// compiled fast path can read directly by offset. Anything else falls
+// back to the normal reflect-based visit.
+type structFieldKind uint8
+
+const (
+	structFieldFallback structFieldKind = iota
+	structFieldInt64
+	structFieldUint64
+	structFieldFloat64
+	structFieldBool
+	structFieldString
 )
+
+type structFieldPlan struct {
+	index       int
+	offset      uintptr
+	kind        structFieldKind
+	flags       visitFlag
+	structField string
+	ignoreZero  bool
+}
+
+type structPlan struct {
+	fields []structFieldPlan
+}
+
+var includableType = reflect.TypeOf((*Includable)(nil)).Elem()
+var includableMapType = reflect.TypeOf((*IncludableMap)(nil)).Elem()
+
+var hashableType = reflect.TypeOf((*Hashable)(nil)).Elem()
+var binaryMarshalerType = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// hasHashHook reports whether t, or a pointer to t, implements one of
+// the self-hashing interfaces that visit tries ahead of reflection
+// (Hashable, encoding.BinaryMarshaler, encoding.TextMarshaler). The
+// compiled fast path must defer to structFieldFallback for such fields
+// instead of reading their raw bytes by offset, or it would bypass the
+// hook and disagree with the reflect path (e.g. a `type Enum string`
+// with a MarshalText method).
+func hasHashHook(t reflect.Type) bool {
+	pt := reflect.PtrTo(t)
+	return t.Implements(hashableType) || pt.Implements(hashableType) ||
+		t.Implements(binaryMarshalerType) || pt.Implements(binaryMarshalerType) ||
+		t.Implements(textMarshalerType) || pt.Implements(textMarshalerType)
+}
+
+// structPlanFor returns the compiled plan for t, building and caching it
+// on first use. It returns nil if t implements Includable/IncludableMap,
+// since field inclusion then depends on the runtime value and can't be
+// precomputed per-type.
+func structPlanFor(t reflect.Type, tagName string) *structPlan {
+	key := structPlanKey{typ: t, tag: tagName}
+	if cached, ok := structPlanCache.Load(key); ok {
+		return cached.(*structPlan)
+	}
+
+	var plan *structPlan
+	if !reflect.PtrTo(t).Implements(includableType) && !t.Implements(includableType) &&
+		!reflect.PtrTo(t).Implements(includableMapType) && !t.Implements(includableMapType) {
+		plan = buildStructPlan(t, tagName)
+	}
+
+	actual, _ := structPlanCache.LoadOrStore(key, plan)
+	return actual.(*structPlan)
+}
+
+func buildStructPlan(t reflect.Type, tagName string) *structPlan {
+	plan := &structPlan{}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			// Unexported field; the reflect-based Struct case skips
+			// these too (see its fieldType.PkgPath check), so both paths
+			// agree on ignoring them per the doc on Hash.
+			continue
+		}
+
+		tagOpts := parseFieldTag(sf.Tag.Get(tagName))
+		if tagOpts.ignore {
+			continue
+		}
+
+		fp := structFieldPlan{index: i, structField: sf.Name, ignoreZero: tagOpts.ignoreZero}
+		if tagOpts.name != "" {
+			fp.structField = tagOpts.name
+		}
+		if tagOpts.set {
+			fp.flags |= visitFlagSet
+		}
+		if tagOpts.string {
+			fp.flags |= visitFlagString
+		}
+
+		if fp.flags == 0 && !hasHashHook(sf.Type) {
+			switch sf.Type.Kind() {
+			case reflect.Int64:
+				fp.kind, fp.offset = structFieldInt64, sf.Offset
+			case reflect.Uint64:
+				fp.kind, fp.offset = structFieldUint64, sf.Offset
+			case reflect.Float64:
+				fp.kind, fp.offset = structFieldFloat64, sf.Offset
+			case reflect.Bool:
+				fp.kind, fp.offset = structFieldBool, sf.Offset
+			case reflect.String:
+				fp.kind, fp.offset = structFieldString, sf.Offset
+			}
+		}
+
+		plan.fields = append(plan.fields, fp)
+	}
+
+	return plan
+}
+
+// hash writes the hash of v, an addressable struct value, using the
+// compiled plan. Fields with a fast structFieldKind are read directly
+// from memory by offset; everything else falls back to w.visit.
+func (p *structPlan) hash(v reflect.Value, w *walker) error {
+	parent := v.Interface()
+	base := unsafe.Pointer(v.UnsafeAddr())
+
+	for _, fp := range p.fields {
+		fv := v.Field(fp.index)
+		if fp.ignoreZero && fv.IsZero() {
+			continue
+		}
+
+		switch fp.kind {
+		case structFieldInt64:
+			val := *(*int64)(unsafe.Pointer(uintptr(base) + fp.offset))
+			if err := binary.Write(w.w, binary.LittleEndian, val); err != nil {
+				return err
+			}
+		case structFieldUint64:
+			val := *(*uint64)(unsafe.Pointer(uintptr(base) + fp.offset))
+			if err := binary.Write(w.w, binary.LittleEndian, val); err != nil {
+				return err
+			}
+		case structFieldFloat64:
+			val := *(*float64)(unsafe.Pointer(uintptr(base) + fp.offset))
+			if err := binary.Write(w.w, binary.LittleEndian, val); err != nil {
+				return err
+			}
+		case structFieldBool:
+			val := *(*bool)(unsafe.Pointer(uintptr(base) + fp.offset))
+			var tmp int8
+			if val {
+				tmp = 1
+			}
+			if err := binary.Write(w.w, binary.LittleEndian, tmp); err != nil {
+				return err
+			}
+		case structFieldString:
+			val := *(*string)(unsafe.Pointer(uintptr(base) + fp.offset))
+			if _, err := w.w.Write([]byte(val)); err != nil {
+				return err
+			}
+		default:
+			if err := w.visit(fv, &visitOpts{
+				Flags:       fp.flags,
+				Struct:      parent,
+				StructField: fp.structField,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,476 @@
+package hashstructure
+
+import (
+	"math/big"
+	"testing"
+	"time"
+)
+
+// big.Int implements encoding.TextMarshaler (and GobEncode) on a
+// pointer receiver, and its state lives entirely in unexported
+// fields. Hashing it is only correct if visit tries the marshaler
+// interfaces on the addressable pointer, not just the dereferenced
+// value.
+func TestHash_bigIntPointerReceiver(t *testing.T) {
+	a, err := Hash(big.NewInt(12345), nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	b, err := Hash(big.NewInt(99999), nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if a == 0 || b == 0 {
+		t.Fatalf("expected non-zero hashes, got a=%d b=%d", a, b)
+	}
+	if a == b {
+		t.Fatalf("expected different big.Ints to hash differently, both got %d", a)
+	}
+}
+
+type pointerMarshaler struct {
+	n int
+}
+
+func (p *pointerMarshaler) MarshalBinary() ([]byte, error) {
+	return []byte{byte(p.n)}, nil
+}
+
+func TestHash_pointerReceiverBinaryMarshaler(t *testing.T) {
+	a, err := Hash(&pointerMarshaler{n: 1}, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	b, err := Hash(&pointerMarshaler{n: 2}, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if a == 0 || b == 0 {
+		t.Fatalf("expected non-zero hashes, got a=%d b=%d", a, b)
+	}
+	if a == b {
+		t.Fatalf("expected different values to hash differently, both got %d", a)
+	}
+}
+
+// A self-referential slice must hash (via a back-reference marker)
+// instead of recursing forever.
+func TestHash_selfReferentialSlice(t *testing.T) {
+	s := make([]interface{}, 1)
+	s[0] = s
+
+	done := make(chan struct{})
+	var h uint64
+	var err error
+	go func() {
+		h, err = Hash(s, nil)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if h == 0 {
+			t.Fatalf("expected a non-zero hash")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Hash did not terminate on a self-referential slice")
+	}
+}
+
+type withUnexported struct {
+	Name   string
+	hidden int
+}
+
+// Structs with unexported fields must hash the same, without panicking,
+// whether the compiled fast path (reached by pointer) or the reflect
+// path (reached by value) is taken; both ignore unexported fields per
+// the doc on Hash.
+func TestHash_unexportedFieldConsistency(t *testing.T) {
+	s := withUnexported{Name: "a", hidden: 1}
+
+	byValue, err := Hash(s, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	byPointer, err := Hash(&s, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if byValue != byPointer {
+		t.Fatalf("expected equal hashes, got byValue=%d byPointer=%d", byValue, byPointer)
+	}
+}
+
+// hookEnum is a named string type whose MarshalText must be honored by the
+// compiled fast path, not just the reflect path; its Kind is the same
+// reflect.String the fast path otherwise reads directly by offset.
+type hookEnum string
+
+func (e hookEnum) MarshalText() ([]byte, error) {
+	return []byte("enum:" + string(e)), nil
+}
+
+type withHookField struct {
+	Name string
+	Kind hookEnum
+}
+
+// A struct field whose type implements a self-hashing hook must hash the
+// same whether the compiled fast path (reached by pointer) or the
+// reflect path (reached by value) is taken, and must actually use the
+// hook rather than the field's raw string bytes.
+func TestHash_structFieldHashHookConsistency(t *testing.T) {
+	a := withHookField{Name: "x", Kind: hookEnum("a")}
+	b := withHookField{Name: "x", Kind: hookEnum("b")}
+
+	aByValue, err := Hash(a, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	aByPointer, err := Hash(&a, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if aByValue != aByPointer {
+		t.Fatalf("expected equal hashes, got byValue=%d byPointer=%d", aByValue, aByPointer)
+	}
+
+	bByPointer, err := Hash(&b, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if aByPointer == bByPointer {
+		t.Fatalf("expected different Kind values to hash differently, both got %d", aByPointer)
+	}
+}
+
+// A map value and a "set"-tagged slice element can themselves be (or
+// contain) the map/slice being hashed; these cycles must be caught the
+// same way plain pointer and slice cycles are.
+func TestHash_selfReferentialMapValue(t *testing.T) {
+	m := make(map[string]interface{}, 1)
+	m["self"] = m
+
+	done := make(chan struct{})
+	var h uint64
+	var err error
+	go func() {
+		h, err = Hash(m, nil)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if h == 0 {
+			t.Fatalf("expected a non-zero hash")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Hash did not terminate on a self-referential map value")
+	}
+}
+
+type withSet struct {
+	Items []interface{} `hash:"set"`
+}
+
+func TestHash_selfReferentialSetSlice(t *testing.T) {
+	s := withSet{Items: make([]interface{}, 1)}
+	s.Items[0] = s
+
+	done := make(chan struct{})
+	var h uint64
+	var err error
+	go func() {
+		h, err = Hash(s, nil)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if h == 0 {
+			t.Fatalf("expected a non-zero hash")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Hash did not terminate on a self-referential set slice")
+	}
+}
+
+// Writing values one at a time must fold them into the running hash in
+// a way that's sensitive to both order and boundaries, unlike combining
+// independently computed Hash results. Boundaries are only kept apart
+// under FormatV2, which length-prefixes strings, so that format is used
+// here.
+func TestHasher_writeOrderAndBoundariesMatter(t *testing.T) {
+	ab := NewHasher(&HashOptions{Format: FormatV2})
+	if err := ab.Write("a"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := ab.Write("b"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ba := NewHasher(&HashOptions{Format: FormatV2})
+	if err := ba.Write("b"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := ba.Write("a"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	combined := NewHasher(&HashOptions{Format: FormatV2})
+	if err := combined.Write("ab"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if ab.Sum64() == ba.Sum64() {
+		t.Fatalf("expected Write order to matter, both got %d", ab.Sum64())
+	}
+	if ab.Sum64() == combined.Sum64() {
+		t.Fatalf("expected separate Writes to differ from one combined Write, both got %d", ab.Sum64())
+	}
+}
+
+// Reset must return a Hasher to the state it was in when created: a
+// self-referential slice (which exercises both the folded hash and the
+// visited/visitedSlices cycle-tracking maps) followed by Reset must
+// leave the Hasher indistinguishable from a freshly constructed one.
+func TestHasher_resetRestoresInitialState(t *testing.T) {
+	h := NewHasher(nil)
+	if err := h.Write("first"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	first := h.Sum64()
+
+	h.Reset()
+
+	s := make([]interface{}, 1)
+	s[0] = s
+	if err := h.Write(s); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	h.Reset()
+
+	fresh := NewHasher(nil)
+	if err := fresh.Write("first"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := fresh.Write("second"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := h.Write("first"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := h.Write("second"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if h.Sum64() != fresh.Sum64() {
+		t.Fatalf("expected Reset to restore initial state, got %d want %d", h.Sum64(), fresh.Sum64())
+	}
+	if h.Sum64() == first {
+		t.Fatalf("expected the reset hasher's final sum to differ from the pre-reset sum")
+	}
+}
+
+type tagComboNamed struct {
+	Value int64 `hash:"name=Count,ignore-zero"`
+}
+
+type tagComboUnnamed struct {
+	Value int64 `hash:"ignore-zero"`
+}
+
+// "ignore-zero" must still take effect when combined with "name=" on the
+// same field, and "name=" must not itself change the produced hash
+// bytes: it only renames the field as seen by Includable/IncludableMap,
+// since field names were never part of the hash to begin with.
+func TestHash_tagCombination_nameAndIgnoreZero(t *testing.T) {
+	zero, err := Hash(tagComboNamed{}, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	empty, err := Hash(struct{}{}, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if zero != empty {
+		t.Fatalf("expected ignore-zero to still skip the zero value, got %d want %d", zero, empty)
+	}
+
+	named, err := Hash(tagComboNamed{Value: 5}, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	unnamed, err := Hash(tagComboUnnamed{Value: 5}, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if named != unnamed {
+		t.Fatalf("expected name= to not affect the hash, got named=%d unnamed=%d", named, unnamed)
+	}
+}
+
+type stringIgnoreZero struct {
+	Count int64 `hash:"string,ignore-zero"`
+}
+
+type stringOnly struct {
+	Count int64 `hash:"string"`
+}
+
+// "string" and "ignore-zero" must compose: the zero value is skipped
+// entirely, and a non-zero value is still hashed via its decimal string
+// form rather than its binary encoding.
+func TestHash_tagCombination_stringAndIgnoreZero(t *testing.T) {
+	zero, err := Hash(stringIgnoreZero{}, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	empty, err := Hash(struct{}{}, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if zero != empty {
+		t.Fatalf("expected ignore-zero to still skip the zero value, got %d want %d", zero, empty)
+	}
+
+	withIgnoreZero, err := Hash(stringIgnoreZero{Count: 7}, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	withoutIgnoreZero, err := Hash(stringOnly{Count: 7}, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if withIgnoreZero != withoutIgnoreZero {
+		t.Fatalf("expected ignore-zero to not affect a non-zero value's string hashing, got %d and %d",
+			withIgnoreZero, withoutIgnoreZero)
+	}
+}
+
+// Under FormatV1, strings are written as raw bytes with no delimiter
+// between successive Writes, so {"ab","c"} and {"a","bc"} fold to the
+// same byte stream. FormatV2 length-prefixes each string, which must
+// disambiguate them.
+func TestHash_formatV2_stringLengthPrefix(t *testing.T) {
+	v1AB := NewHasher(&HashOptions{Format: FormatV1})
+	if err := v1AB.Write("ab"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := v1AB.Write("c"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	v1ABC := NewHasher(&HashOptions{Format: FormatV1})
+	if err := v1ABC.Write("a"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := v1ABC.Write("bc"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if v1AB.Sum64() != v1ABC.Sum64() {
+		t.Fatalf("expected FormatV1 to collide on these boundaries, got %d and %d", v1AB.Sum64(), v1ABC.Sum64())
+	}
+
+	v2AB := NewHasher(&HashOptions{Format: FormatV2})
+	if err := v2AB.Write("ab"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := v2AB.Write("c"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	v2ABC := NewHasher(&HashOptions{Format: FormatV2})
+	if err := v2ABC.Write("a"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := v2ABC.Write("bc"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if v2AB.Sum64() == v2ABC.Sum64() {
+		t.Fatalf("expected FormatV2 to not collide on these boundaries, both got %d", v2AB.Sum64())
+	}
+}
+
+// Under FormatV1, scalars carry no kind tag (nil and false both encode
+// to a single zero byte). FormatV2's kind tag must keep int64(0), "",
+// nil, and false apart.
+func TestHash_formatV2_scalarKindTagging(t *testing.T) {
+	opts := &HashOptions{Format: FormatV2}
+
+	zeroInt, err := Hash(int64(0), opts)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	emptyStr, err := Hash("", opts)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var nilVal interface{}
+	nilHash, err := Hash(nilVal, opts)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	falseHash, err := Hash(false, opts)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	seen := map[uint64]bool{}
+	for _, h := range []uint64{zeroInt, emptyStr, nilHash, falseHash} {
+		if seen[h] {
+			t.Fatalf("expected int64(0), \"\", nil, and false to hash differently under FormatV2, got a repeat of %d", h)
+		}
+		seen[h] = true
+	}
+}
+
+type setField struct {
+	Items []int64 `hash:"set"`
+}
+
+// Under FormatV1, a set containing a value twice XORs to the same
+// combined hash as an empty set. FormatV2 folds in the entry count,
+// which must keep these apart.
+func TestHash_formatV2_setDuplicateVsEmpty(t *testing.T) {
+	v1Duplicate, err := Hash(setField{Items: []int64{5, 5}}, &HashOptions{Format: FormatV1})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	v1Empty, err := Hash(setField{Items: []int64{}}, &HashOptions{Format: FormatV1})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if v1Duplicate != v1Empty {
+		t.Fatalf("expected FormatV1 to collide here, got %d and %d", v1Duplicate, v1Empty)
+	}
+
+	v2Duplicate, err := Hash(setField{Items: []int64{5, 5}}, &HashOptions{Format: FormatV2})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	v2Empty, err := Hash(setField{Items: []int64{}}, &HashOptions{Format: FormatV2})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if v2Duplicate == v2Empty {
+		t.Fatalf("expected FormatV2 to not collide here, both got %d", v2Duplicate)
+	}
+}